@@ -0,0 +1,140 @@
+//go:build linux
+
+package ptywrapper
+
+import (
+  // Modules in GOROOT
+  "errors"
+  "fmt"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "syscall"
+  "time"
+)
+
+//
+//// CGROUPS
+//
+
+// CgroupSpec bounds the resources available to a command via a Linux
+// cgroup v2 sub-cgroup. The child is placed into it atomically at clone
+// time (SysProcAttr.UseCgroupFD), rather than racing to write
+// cgroup.procs after fork.
+type CgroupSpec struct {
+  // Parent is the cgroup v2 directory the command's sub-cgroup is created
+  // under, e.g. "/sys/fs/cgroup/ptywrapper.slice". It must already exist.
+  Parent string
+
+  // MemoryMax caps memory.max, in bytes. Zero leaves the controller unset.
+  MemoryMax int64
+
+  // CPUMax is written verbatim to cpu.max, e.g. "50000 100000". Empty
+  // leaves the controller unset.
+  CPUMax string
+
+  // PidsMax caps pids.max. Zero leaves the controller unset.
+  PidsMax int64
+}
+
+// CgroupStats reports resource usage collected from the command's
+// sub-cgroup once it has exited.
+type CgroupStats struct {
+  // PeakMemoryBytes is memory.peak at the time the sub-cgroup was torn down.
+  PeakMemoryBytes int64
+
+  // CPUUsageMicros is cpu.stat's usage_usec at the time the sub-cgroup was
+  // torn down.
+  CPUUsageMicros int64
+}
+
+// setupCgroup creates a uniquely named sub-cgroup under spec.Parent, writes
+// the configured controller files, and returns an open directory fd (for
+// SysProcAttr.CgroupFD) alongside the directory path. It returns a
+// descriptive error, rather than panicking, when cgroup v2 isn't mounted at
+// Parent.
+func setupCgroup(spec *CgroupSpec) (dirFile *os.File, dir string, err error) {
+  if spec.Parent == "" {
+    return nil, "", errors.New("ptywrapper: Cgroup.Parent must be set")
+  }
+
+  if _, err := os.Stat(filepath.Join(spec.Parent, "cgroup.controllers")); err != nil {
+    return nil, "", fmt.Errorf("ptywrapper: cgroup v2 not available under %q: %w", spec.Parent, err)
+  }
+
+  dir = filepath.Join(spec.Parent, fmt.Sprintf("ptywrapper-%d-%d", os.Getpid(), time.Now().UnixNano()))
+  if err := os.Mkdir(dir, 0755); err != nil {
+    return nil, "", fmt.Errorf("ptywrapper: creating cgroup directory: %w", err)
+  }
+
+  writeController := func(name, value string) error {
+    if value == "" {
+      return nil
+    }
+    return os.WriteFile(filepath.Join(dir, name), []byte(value), 0644)
+  }
+
+  var memoryMax, pidsMax string
+  if spec.MemoryMax > 0 {
+    memoryMax = strconv.FormatInt(spec.MemoryMax, 10)
+  }
+  if spec.PidsMax > 0 {
+    pidsMax = strconv.FormatInt(spec.PidsMax, 10)
+  }
+
+  for _, ctrl := range []struct{ name, value string }{
+    {"memory.max", memoryMax},
+    {"cpu.max", spec.CPUMax},
+    {"pids.max", pidsMax},
+  } {
+    if err := writeController(ctrl.name, ctrl.value); err != nil {
+      os.RemoveAll(dir)
+      return nil, "", fmt.Errorf("ptywrapper: writing %s: %w", ctrl.name, err)
+    }
+  }
+
+  dirFile, err = os.Open(dir)
+  if err != nil {
+    os.RemoveAll(dir)
+    return nil, "", fmt.Errorf("ptywrapper: opening cgroup directory: %w", err)
+  }
+
+  return dirFile, dir, nil
+}
+
+// teardownCgroup reads the final stats out of dir, then closes dirFile and
+// removes the sub-cgroup.
+func teardownCgroup(dirFile *os.File, dir string) CgroupStats {
+  var stats CgroupStats
+
+  if data, err := os.ReadFile(filepath.Join(dir, "memory.peak")); err == nil {
+    if v, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err == nil {
+      stats.PeakMemoryBytes = v
+    }
+  }
+
+  if data, err := os.ReadFile(filepath.Join(dir, "cpu.stat")); err == nil {
+    for _, line := range strings.Split(string(data), "\n") {
+      fields := strings.Fields(line)
+      if len(fields) == 2 && fields[0] == "usage_usec" {
+        if v, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+          stats.CPUUsageMicros = v
+        }
+      }
+    }
+  }
+
+  _ = dirFile.Close()
+  _ = os.RemoveAll(dir)
+
+  return stats
+}
+
+// applyCgroupFD places the child into the cgroup opened as fd atomically at
+// clone time (kernel >= 5.7), instead of racing to write cgroup.procs after
+// fork.
+func applyCgroupFD(attr *syscall.SysProcAttr, fd int) {
+  attr.UseCgroupFD = true
+  attr.CgroupFD = fd
+}
@@ -0,0 +1,63 @@
+//go:build !linux
+
+package ptywrapper
+
+import (
+  // Modules in GOROOT
+  "fmt"
+  "os"
+  "syscall"
+)
+
+//
+//// CGROUPS
+//
+
+// CgroupSpec bounds the resources available to a command via a Linux
+// cgroup v2 sub-cgroup. Cgroup confinement is only available on linux; on
+// other platforms, setting Command.Cgroup makes Start fail with a
+// descriptive error instead of confining anything.
+type CgroupSpec struct {
+  // Parent is the cgroup v2 directory the command's sub-cgroup is created
+  // under, e.g. "/sys/fs/cgroup/ptywrapper.slice". It must already exist.
+  Parent string
+
+  // MemoryMax caps memory.max, in bytes. Zero leaves the controller unset.
+  MemoryMax int64
+
+  // CPUMax is written verbatim to cpu.max, e.g. "50000 100000". Empty
+  // leaves the controller unset.
+  CPUMax string
+
+  // PidsMax caps pids.max. Zero leaves the controller unset.
+  PidsMax int64
+}
+
+// CgroupStats reports resource usage collected from the command's
+// sub-cgroup once it has exited. Always zero on non-linux platforms.
+type CgroupStats struct {
+  // PeakMemoryBytes is memory.peak at the time the sub-cgroup was torn down.
+  PeakMemoryBytes int64
+
+  // CPUUsageMicros is cpu.stat's usage_usec at the time the sub-cgroup was
+  // torn down.
+  CPUUsageMicros int64
+}
+
+// setupCgroup always fails on non-linux platforms: cgroup v2 confinement
+// depends on SysProcAttr.UseCgroupFD, which only exists on linux.
+func setupCgroup(spec *CgroupSpec) (dirFile *os.File, dir string, err error) {
+  return nil, "", fmt.Errorf("ptywrapper: Cgroup is only supported on linux")
+}
+
+// teardownCgroup is never reached in practice on non-linux platforms, since
+// setupCgroup always fails first, but is kept so Start's teardown path
+// still compiles.
+func teardownCgroup(dirFile *os.File, dir string) CgroupStats {
+  return CgroupStats{}
+}
+
+// applyCgroupFD is a no-op on non-linux platforms; setupCgroup above
+// already fails before Start would reach this.
+func applyCgroupFD(attr *syscall.SysProcAttr, fd int) {
+}
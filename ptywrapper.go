@@ -13,7 +13,10 @@ import (
   "bytes"
   "strings"
   "regexp"
+  "errors"
   "io"
+  "fmt"
+  "encoding/json"
 
   // External modules
   "github.com/creack/pty"
@@ -25,12 +28,13 @@ import (
 //// STRINGS
 //
 
+// ansiEscapePattern matches ANSI escape sequences, so they can be stripped
+// out of captured/matched terminal output.
+var ansiEscapePattern = regexp.MustCompile(`\x1b\[[0-9;]*[a-zA-Z]`)
+
 func cleanupString(originalString string) string {
-  // Regular expression pattern to match ANSI escape sequences
   // This makes it easier to store, parse, read and use the command output as input for other programs
-  reg := regexp.MustCompile(`\x1b\[[0-9;]*[a-zA-Z]`)
-
-  cleanedString := reg.ReplaceAllString(originalString, "")
+  cleanedString := ansiEscapePattern.ReplaceAllString(originalString, "")
 
   // Remove the first and last newline characters, if they exist.
   cleanedString = strings.TrimLeft(cleanedString, "\n")
@@ -43,9 +47,26 @@ func cleanupString(originalString string) string {
 }
 
 //
-//// CONTEXT
+//// ERRORS
 //
 
+var (
+  // ErrCanceled is returned by Wait/RunInPTYContext when the command is stopped
+  // because its context was canceled before the child exited on its own.
+  ErrCanceled = errors.New("ptywrapper: command canceled")
+
+  // ErrTimeout is returned by Wait when Command.Timeout elapses before the child
+  // exits on its own.
+  ErrTimeout = errors.New("ptywrapper: command timed out")
+)
+
+// defaultKillGracePeriod is how long we wait after SIGTERM before escalating to
+// SIGKILL when no Command.KillGracePeriod is configured.
+const defaultKillGracePeriod = 5 * time.Second
+
+//
+//// CONTEXT
+//
 
 type contextWrapper struct {
   Ctx     context.Context
@@ -70,8 +91,8 @@ func generateContextWrapper() contextWrapper {
 //
 
 type Writer struct {
-  src     *os.File
-  dest    *os.File
+  src     io.Reader
+  dest    io.Writer
   ctx     contextWrapper
 }
 
@@ -79,6 +100,355 @@ func (w *Writer) Write(p []byte) (n int, err error) {
   return w.dest.Write(p)
 }
 
+//
+//// BROADCASTER
+//
+
+// WriterPolicy controls what happens to a subscriber registered via
+// AddOutputWriter/AddInputWriter when it can't keep up with the stream.
+type WriterPolicy int
+
+const (
+  // WriterPolicyBlock back-pressures the copy loop until the slow subscriber
+  // catches up. This is the zero value.
+  WriterPolicyBlock WriterPolicy = iota
+
+  // WriterPolicyDrop discards chunks destined for a subscriber that falls
+  // behind, instead of stalling the rest of the stream.
+  WriterPolicyDrop
+)
+
+// defaultReplayBytes bounds how much history a byteRing keeps for replay when
+// Command.ReplayBytes is left unset.
+const defaultReplayBytes = 64 * 1024
+
+// subscriberBufferSize is how many pending chunks a subscriber's goroutine
+// will queue before WriterPolicyDrop starts discarding or WriterPolicyBlock
+// starts stalling the broadcaster.
+const subscriberBufferSize = 256
+
+// byteRing keeps the trailing N bytes written to it, for replaying to newly
+// registered subscribers.
+type byteRing struct {
+  mu  sync.Mutex
+  cap int
+  buf []byte
+}
+
+func newByteRing(cap int) *byteRing {
+  if cap <= 0 {
+    cap = defaultReplayBytes
+  }
+
+  return &byteRing{cap: cap}
+}
+
+func (r *byteRing) Write(p []byte) (int, error) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+
+  r.buf = append(r.buf, p...)
+  if len(r.buf) > r.cap {
+    r.buf = r.buf[len(r.buf)-r.cap:]
+  }
+
+  return len(p), nil
+}
+
+func (r *byteRing) Bytes() []byte {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+
+  out := make([]byte, len(r.buf))
+  copy(out, r.buf)
+
+  return out
+}
+
+// subscription is a single registered output/input writer, fed through its
+// own buffered channel so one slow subscriber cannot stall the others.
+// closed/mu serialize the channel's close against in-flight sends from
+// write(), so neither side can race the other into a send-on-closed-channel
+// panic.
+type subscription struct {
+  w      io.Writer
+  policy WriterPolicy
+  ch     chan []byte
+
+  mu     sync.Mutex
+  closed bool
+}
+
+// broadcaster tees bytes written to it to any number of registered
+// io.Writer subscribers, inspired by the WriteBroadcaster pattern used in
+// process supervisors. wg tracks every subscriber's delivery goroutine, so
+// close can block until all of them have actually returned from Write.
+type broadcaster struct {
+  mu          sync.Mutex
+  wg          sync.WaitGroup
+  nextID      int
+  subscribers map[int]*subscription
+}
+
+func newBroadcaster() *broadcaster {
+  return &broadcaster{subscribers: make(map[int]*subscription)}
+}
+
+// add registers w, replaying the given bytes to it before live chunks start
+// arriving. policy controls how this subscriber (and only this subscriber)
+// is treated if it falls behind. The returned func unsubscribes w; it does
+// not wait for w's delivery goroutine to drain (use close for that).
+func (b *broadcaster) add(w io.Writer, policy WriterPolicy, replay []byte) (unsubscribe func()) {
+  sub := &subscription{
+    w:      w,
+    policy: policy,
+    ch:     make(chan []byte, subscriberBufferSize),
+  }
+
+  // Enqueue the replay before sub is visible in b.subscribers, so a
+  // concurrent write() can't land ahead of it and reorder history in front
+  // of live bytes.
+  if len(replay) > 0 {
+    replayed := make([]byte, len(replay))
+    copy(replayed, replay)
+    sub.ch <- replayed
+  }
+
+  b.mu.Lock()
+  id := b.nextID
+  b.nextID++
+  b.subscribers[id] = sub
+  b.mu.Unlock()
+
+  b.wg.Add(1)
+  go func() {
+    defer b.wg.Done()
+
+    for p := range sub.ch {
+      _, _ = sub.w.Write(p)
+    }
+  }()
+
+  return func() {
+    b.mu.Lock()
+    delete(b.subscribers, id)
+    b.mu.Unlock()
+
+    b.closeSub(sub)
+  }
+}
+
+// closeSub marks sub closed and closes its channel, guarded by sub.mu so it
+// can never race a concurrent write() into sending on a closed channel.
+func (b *broadcaster) closeSub(sub *subscription) {
+  sub.mu.Lock()
+  defer sub.mu.Unlock()
+
+  if sub.closed {
+    return
+  }
+  sub.closed = true
+  close(sub.ch)
+}
+
+// close unsubscribes every remaining subscriber and blocks until their
+// delivery goroutines have drained whatever was already queued and
+// returned, so that once close returns, every chunk handed to write before
+// the call has actually reached a Write call.
+func (b *broadcaster) close() {
+  b.mu.Lock()
+  subs := make([]*subscription, 0, len(b.subscribers))
+  for _, sub := range b.subscribers {
+    subs = append(subs, sub)
+  }
+  b.subscribers = make(map[int]*subscription)
+  b.mu.Unlock()
+
+  for _, sub := range subs {
+    b.closeSub(sub)
+  }
+
+  b.wg.Wait()
+}
+
+// write tees p to every registered subscriber, applying each subscriber's
+// own policy to whichever ones are behind.
+func (b *broadcaster) write(p []byte) {
+  if len(p) == 0 {
+    return
+  }
+
+  chunk := make([]byte, len(p))
+  copy(chunk, p)
+
+  b.mu.Lock()
+  subs := make([]*subscription, 0, len(b.subscribers))
+  for _, sub := range b.subscribers {
+    subs = append(subs, sub)
+  }
+  b.mu.Unlock()
+
+  for _, sub := range subs {
+    sub.mu.Lock()
+    if sub.closed {
+      sub.mu.Unlock()
+      continue
+    }
+
+    if sub.policy == WriterPolicyDrop {
+      select {
+      case sub.ch <- chunk:
+      default:
+        // Subscriber is behind; drop this chunk rather than stall the command
+      }
+    } else {
+      sub.ch <- chunk
+    }
+    sub.mu.Unlock()
+  }
+}
+
+//
+//// RECORDING
+//
+
+// RecordFormat selects the on-disk format used by Command.RecordTo.
+// Asciicast v2 is currently the only supported format.
+type RecordFormat int
+
+const (
+  // RecordFormatAsciicastV2 is the asciinema asciicast v2 format: a header
+  // line followed by one JSON array per event. This is the zero value.
+  RecordFormatAsciicastV2 RecordFormat = iota
+)
+
+// recorderBufferSize bounds how many pending events the recorder's writer
+// goroutine will queue before events start being dropped, so a slow
+// Command.RecordTo can never stall the copy loops.
+const recorderBufferSize = 256
+
+// asciicastHeader is the first line of an asciicast v2 recording.
+type asciicastHeader struct {
+  Version   int               `json:"version"`
+  Width     int               `json:"width"`
+  Height    int               `json:"height"`
+  Timestamp int64             `json:"timestamp"`
+  Env       map[string]string `json:"env"`
+}
+
+type asciicastEvent struct {
+  elapsed float64
+  kind    string
+  data    string
+}
+
+// asciicastRecorder writes an asciicast v2 session recording. It is
+// goroutine-safe and never blocks the caller of record/resize: events are
+// queued on a buffered channel and written by a dedicated goroutine.
+type asciicastRecorder struct {
+  start   time.Time
+  events  chan asciicastEvent
+  done    chan struct{}
+  wg      sync.WaitGroup
+}
+
+func newAsciicastRecorder(w io.Writer, width, height int) (*asciicastRecorder, error) {
+  header := asciicastHeader{
+    Version:   2,
+    Width:     width,
+    Height:    height,
+    Timestamp: time.Now().Unix(),
+    Env: map[string]string{
+      "SHELL": os.Getenv("SHELL"),
+      "TERM":  os.Getenv("TERM"),
+    },
+  }
+
+  enc := json.NewEncoder(w)
+  if err := enc.Encode(header); err != nil {
+    return nil, err
+  }
+
+  rec := &asciicastRecorder{
+    start:  time.Now(),
+    events: make(chan asciicastEvent, recorderBufferSize),
+    done:   make(chan struct{}),
+  }
+
+  rec.wg.Add(1)
+  go rec.run(enc)
+
+  return rec, nil
+}
+
+func (r *asciicastRecorder) run(enc *json.Encoder) {
+  defer r.wg.Done()
+
+  for {
+    select {
+    case ev, ok := <-r.events:
+      if !ok {
+        return
+      }
+      _ = enc.Encode([]interface{}{ev.elapsed, ev.kind, ev.data})
+    case <-r.done:
+      // Drain whatever is already queued before exiting
+      for {
+        select {
+        case ev, ok := <-r.events:
+          if !ok {
+            return
+          }
+          _ = enc.Encode([]interface{}{ev.elapsed, ev.kind, ev.data})
+        default:
+          return
+        }
+      }
+    }
+  }
+}
+
+// record queues a single "o"/"i" event. It is a no-op on a nil receiver so
+// call sites don't need to guard every call with a recording-enabled check.
+func (r *asciicastRecorder) record(kind string, data []byte) {
+  if r == nil || len(data) == 0 {
+    return
+  }
+
+  ev := asciicastEvent{
+    elapsed: time.Since(r.start).Seconds(),
+    kind:    kind,
+    data:    string(data),
+  }
+
+  select {
+  case r.events <- ev:
+  default:
+    // Writer goroutine is behind; drop rather than block the copy loop
+  }
+}
+
+// resize queues a "r" (resize) event.
+func (r *asciicastRecorder) resize(cols, rows int) {
+  if r == nil {
+    return
+  }
+
+  r.record("r", []byte(fmt.Sprintf("%dx%d", cols, rows)))
+}
+
+// close stops accepting new events, flushes whatever is already queued and
+// waits for the writer goroutine to finish.
+func (r *asciicastRecorder) close() {
+  if r == nil {
+    return
+  }
+
+  close(r.done)
+  r.wg.Wait()
+  close(r.events)
+}
+
 //
 //// COMMAND
 //
@@ -91,9 +461,277 @@ type Command struct {
   Completed   bool
   Output      string
   ExitCode    int
+
+  // Timeout, when non-zero, bounds how long the command is allowed to run.
+  // Once it elapses, the child is terminated and Wait returns ErrTimeout.
+  Timeout     time.Duration
+
+  // KillGracePeriod is how long to wait, after the child has been asked to
+  // terminate (via Timeout or context cancellation), before escalating from
+  // SIGTERM to SIGKILL. Defaults to defaultKillGracePeriod when zero.
+  KillGracePeriod time.Duration
+
+  // Stdin, when set, replaces os.Stdin as the source copied into the pty.
+  // Leave nil to keep the default interactive behaviour (raw mode, resize
+  // handling via SIGWINCH).
+  Stdin       io.Reader
+
+  // Stdout, when set, replaces os.Stdout as the live destination for the
+  // pty's output.
+  Stdout      io.Writer
+
+  // ReplayBytes bounds how much already-produced history is replayed to a
+  // writer registered via AddOutputWriter/AddInputWriter before it starts
+  // receiving live bytes. Defaults to defaultReplayBytes when zero.
+  ReplayBytes int
+
+  // WriterPolicy is the default passed to AddOutputWriter/AddInputWriter by
+  // callers that don't need a per-subscriber override. Defaults to
+  // WriterPolicyBlock.
+  WriterPolicy WriterPolicy
+
+  // RecordTo, when set, captures the session to an asciicast v2 recording as
+  // it runs. Nil (the default) disables recording entirely.
+  RecordTo     io.Writer
+
+  // RecordFormat selects the format written to RecordTo. Currently only
+  // RecordFormatAsciicastV2 (the zero value) is supported.
+  RecordFormat RecordFormat
+
+  // RecordInput additionally captures bytes sent to the child's stdin as "i"
+  // events. Output ("o") and resize ("r") events are always captured when
+  // RecordTo is set.
+  RecordInput  bool
+
+  // SeparateStderr, when true, gives the child's stderr its own os.Pipe
+  // instead of interleaving it into the pty. stdin/stdout stay on the pty,
+  // so interactive programs still see a TTY on fd 0/1, but diagnostics end
+  // up in Stderr instead of mixed into Output.
+  SeparateStderr bool
+
+  // MaxStderrBytes caps how much of stderr is captured in the Stderr field
+  // when SeparateStderr is enabled, so a runaway child can't exhaust memory.
+  // Bytes beyond the cap are dropped and StderrTruncated is set. Zero means
+  // unbounded.
+  MaxStderrBytes  int64
+
+  // StderrWriter, when set, additionally receives every chunk read from the
+  // child's stderr, live, in SeparateStderr mode.
+  StderrWriter    io.Writer
+
+  // Stderr holds the child's stderr once Wait returns, when SeparateStderr
+  // is enabled.
+  Stderr          string
+
+  // StderrTruncated is set when Stderr was capped by MaxStderrBytes.
+  StderrTruncated bool
+
+  // Cgroup, when set, confines the child to a Linux cgroup v2 sub-cgroup
+  // with the given resource limits. Nil (the default) runs unconfined.
+  Cgroup *CgroupSpec
+
+  // CgroupStats reports resource usage collected from the sub-cgroup once
+  // the command has exited. Only populated when Cgroup is set.
+  CgroupStats CgroupStats
+
+  // ExpectBufferSize bounds how much decoded output a Session created via
+  // NewSession keeps around for Expect/ExpectAny to search, discarding the
+  // oldest bytes once the cap is hit. Defaults to defaultExpectBufferSize.
+  ExpectBufferSize int
+
+  // LogExpect, when set, receives a line for every Expect/ExpectAny call
+  // that matches, times out, or hits EOF, for debugging.
+  LogExpect io.Writer
+
+  // Internal state shared between Start and Wait
+  cmd               *exec.Cmd
+  primary           *os.File
+  secondary         *os.File
+  stdinFd           int
+  stdinIsRaw        bool
+  oldState          *term.State
+  execCtx           contextWrapper
+  cmdOutput         bytes.Buffer
+  ptyWriterWG       sync.WaitGroup
+  stdoutWriterWG    sync.WaitGroup
+  cmdExecutionWG    sync.WaitGroup
+  cmdExitCh         chan error
+  cmdExited         chan struct{}
+  terminationOnce   sync.Once
+  terminationErr    error
+
+  bcMu              sync.Mutex
+  outputBC          *broadcaster
+  outputRing        *byteRing
+  inputBC           *broadcaster
+  inputRing         *byteRing
+
+  recorderMu        sync.Mutex
+  recorder          *asciicastRecorder
+  sigwinchWG        sync.WaitGroup
+
+  stderrRead        *os.File
+  stderrWriterWG    sync.WaitGroup
+  stderrMu          sync.Mutex
+  stderrBuf         bytes.Buffer
+
+  cgroupDir         string
+  cgroupDirFile     *os.File
+}
+
+// appendStderr records a chunk of stderr output, honoring MaxStderrBytes.
+func (command *Command) appendStderr(p []byte) {
+  command.stderrMu.Lock()
+  defer command.stderrMu.Unlock()
+
+  if command.MaxStderrBytes > 0 {
+    remaining := command.MaxStderrBytes - int64(command.stderrBuf.Len())
+    if remaining <= 0 {
+      command.StderrTruncated = true
+      return
+    }
+    if int64(len(p)) > remaining {
+      p = p[:remaining]
+      command.StderrTruncated = true
+    }
+  }
+
+  command.stderrBuf.Write(p)
+}
+
+// ensureOutputBroadcaster lazily creates the output broadcaster/ring so that
+// AddOutputWriter can be called before Start.
+func (command *Command) ensureOutputBroadcaster() *broadcaster {
+  command.bcMu.Lock()
+  defer command.bcMu.Unlock()
+
+  if command.outputBC == nil {
+    command.outputBC = newBroadcaster()
+  }
+  if command.outputRing == nil {
+    command.outputRing = newByteRing(command.ReplayBytes)
+  }
+
+  return command.outputBC
+}
+
+// ensureInputBroadcaster lazily creates the input broadcaster/ring so that
+// AddInputWriter can be called before Start.
+func (command *Command) ensureInputBroadcaster() *broadcaster {
+  command.bcMu.Lock()
+  defer command.bcMu.Unlock()
+
+  if command.inputBC == nil {
+    command.inputBC = newBroadcaster()
+  }
+  if command.inputRing == nil {
+    command.inputRing = newByteRing(command.ReplayBytes)
+  }
+
+  return command.inputBC
+}
+
+// AddOutputWriter registers w to receive a replay of the output buffered so
+// far (bounded by ReplayBytes) followed by every live chunk read from the
+// pty. policy governs only this subscriber, so one caller can ask for
+// WriterPolicyBlock while another uses WriterPolicyDrop on the same command.
+// Call the returned unsubscribe func to stop feeding w.
+func (command *Command) AddOutputWriter(w io.Writer, policy WriterPolicy) (unsubscribe func()) {
+  bc := command.ensureOutputBroadcaster()
+
+  return bc.add(w, policy, command.outputRing.Bytes())
+}
+
+// AddInputWriter registers w to receive a replay of the input sent so far
+// (bounded by ReplayBytes) followed by every live chunk written to the pty's
+// stdin. policy governs only this subscriber; see AddOutputWriter. Call the
+// returned unsubscribe func to stop feeding w.
+func (command *Command) AddInputWriter(w io.Writer, policy WriterPolicy) (unsubscribe func()) {
+  bc := command.ensureInputBroadcaster()
+
+  return bc.add(w, policy, command.inputRing.Bytes())
+}
+
+// PTY returns the primary (ptm) side of the pseudo-terminal allocated for the
+// command. It is only valid after Start has returned successfully.
+func (command *Command) PTY() *os.File {
+  return command.primary
+}
+
+// Cmd returns the underlying *exec.Cmd driving the child process. It is only
+// valid after Start has returned successfully.
+func (command *Command) Cmd() *exec.Cmd {
+  return command.cmd
+}
+
+// PID returns the running child's process ID, or -1 if the command has not
+// been started yet.
+func (command *Command) PID() int {
+  if command.cmd == nil || command.cmd.Process == nil {
+    return -1
+  }
+
+  return command.cmd.Process.Pid
+}
+
+// Done returns a channel that is closed once the child has exited, or as soon
+// as Timeout or context cancellation asks it to terminate, whichever comes
+// first. It is closed before the pty is closed and before subscribers have
+// been handed the last of the output. It is nil until Start has returned
+// successfully. Unlike Wait, reading Done does not consume the exit
+// status, so other code can observe completion without racing the one
+// caller that owns Wait.
+func (command *Command) Done() <-chan struct{} {
+  if command.execCtx.Ctx == nil {
+    return nil
+  }
+
+  return command.execCtx.Ctx.Done()
 }
 
-func (command *Command) RunInPTY() (Command, error) {
+// terminate asks the child to exit, escalating from SIGTERM to SIGKILL after
+// KillGracePeriod if it doesn't, and cancels the execution context so the copy
+// goroutines and Wait unblock. Only the first call has any effect; err is the
+// classified error later returned by Wait.
+func (command *Command) terminate(err error) {
+  command.terminationOnce.Do(func() {
+    command.terminationErr = err
+
+    if command.cmd != nil && command.cmd.Process != nil {
+      pid := command.cmd.Process.Pid
+
+      // Negative pid targets the whole process group, since the child was
+      // started with Setsid (it is its own group leader)
+      _ = syscall.Kill(-pid, syscall.SIGTERM)
+
+      grace := command.KillGracePeriod
+      if grace <= 0 {
+        grace = defaultKillGracePeriod
+      }
+
+      go func() {
+        select {
+        case <-command.cmdExited:
+          // Process already reaped, nothing else to do
+        case <-time.After(grace):
+          _ = syscall.Kill(-pid, syscall.SIGKILL)
+        }
+      }()
+    }
+
+    command.execCtx.Cancel()
+  })
+}
+
+// Start opens a pty, launches the command attached to it, and returns as soon
+// as the child and the stdin/stdout copy goroutines are running. Use PTY,
+// Cmd and PID to inspect the running command, and Wait to block until it
+// finishes.
+func (command *Command) Start() (startErr error) {
+  if command.RecordTo != nil && command.RecordFormat != RecordFormatAsciicastV2 {
+    return fmt.Errorf("ptywrapper: unsupported RecordFormat %v", command.RecordFormat)
+  }
+
   // Create a command
   c := exec.Command(command.Entry, command.Args...)
   c.SysProcAttr = &syscall.SysProcAttr{
@@ -101,6 +739,30 @@ func (command *Command) RunInPTY() (Command, error) {
     Setsid: true, // Start the command in a new session
   }
 
+  // Confine the child to a cgroup v2 sub-cgroup, if requested. Placing it
+  // via CgroupFD means it lands in the cgroup atomically at clone time,
+  // instead of racing to write cgroup.procs after fork. Both setupCgroup
+  // and applyCgroupFD are platform-specific (see cgroup_linux.go /
+  // cgroup_other.go); on non-linux platforms applyCgroupFD is a no-op and
+  // is never reached, since setupCgroup always fails there first.
+  var cgroupDirFile *os.File
+  var cgroupDir string
+  if command.Cgroup != nil {
+    var cgroupErr error
+    cgroupDirFile, cgroupDir, cgroupErr = setupCgroup(command.Cgroup)
+    if cgroupErr != nil {
+      return cgroupErr
+    }
+
+    applyCgroupFD(c.SysProcAttr, int(cgroupDirFile.Fd()))
+  }
+  defer func() {
+    if startErr != nil && cgroupDirFile != nil {
+      cgroupDirFile.Close()
+      os.RemoveAll(cgroupDir)
+    }
+  }()
+
   // Set environment (use custom environment if available)
   if command.Env != nil {
     c.Env = command.Env
@@ -114,81 +776,194 @@ func (command *Command) RunInPTY() (Command, error) {
   //   - secondary => pts (slave)
   primary, secondary, err := pty.Open()
   if err != nil {
-    return *command, err
+    return err
   }
-  defer primary.Close()
-  defer secondary.Close()
 
   // Set stdin, stdout and sterr for the command
   c.Stdin = secondary
   c.Stdout = secondary
-  c.Stderr = secondary
-
-  // Get the file descriptor for stdin
-  fd := int(os.Stdin.Fd())
 
-  // Make stdin raw and save the old state
-  oldState, err := term.MakeRaw(fd)
-  if err != nil {
-    return *command, err
+  // In SeparateStderr mode, stderr gets its own pipe instead of being
+  // interleaved into the pty, so callers can tell diagnostics apart from
+  // normal output. stdin/stdout stay on the pty either way, so interactive
+  // programs still see a TTY on fd 0/1.
+  var stderrRead, stderrWrite *os.File
+  if command.SeparateStderr {
+    stderrRead, stderrWrite, err = os.Pipe()
+    if err != nil {
+      primary.Close()
+      secondary.Close()
+      return err
+    }
+    c.Stderr = stderrWrite
+  } else {
+    c.Stderr = secondary
   }
-  defer func() { _ = term.Restore(fd, oldState) }() // Ensure the old state is restored when the function returns
 
-  // Enable non-blocking I/O on stdin
-  flag, err := unix.FcntlInt(uintptr(fd), unix.F_GETFL, 0)
-  if err != nil {
-    return *command, err
-  }
-  flag, err = unix.FcntlInt(uintptr(fd), unix.F_SETFL, flag|unix.O_NONBLOCK)
-  if err != nil {
-    return *command, err
-  }
+  // Create a context to track if the command is still running. This is
+  // created before the command actually starts so the SIGWINCH listener
+  // below can use it to know when to stop, for the command's whole life.
+  command.execCtx = generateContextWrapper()
 
-  // Resize the pty
-  ch := make(chan os.Signal, 1)
-  errCh := make(chan error, 1)
-  signal.Notify(ch, syscall.SIGWINCH)
-  go func() {
-    for range ch {
-      if err := pty.InheritSize(os.Stdin, primary); err != nil {
-        errCh <- err // Send the error to the error channel
-        return
-      }
+  // Use the caller-supplied stdin/stdout when given, otherwise fall back to
+  // the interactive defaults (raw mode + SIGWINCH-driven resize only make
+  // sense when we're really talking to os.Stdin)
+  stdinIsRaw := command.Stdin == nil
+
+  var stdinSrc io.Reader
+  var fd int
+  var oldState *term.State
+
+  if stdinIsRaw {
+    stdinSrc = os.Stdin
+
+    // Get the file descriptor for stdin
+    fd = int(os.Stdin.Fd())
+
+    // Make stdin raw and save the old state
+    oldState, err = term.MakeRaw(fd)
+    if err != nil {
+      primary.Close()
+      secondary.Close()
+      return err
     }
-  }()
-  ch <- syscall.SIGWINCH // Initial resize
-  select {
-  case err := <-errCh:
-    return *command, err
-  default:
-    // No error, continue execution
+
+    // Enable non-blocking I/O on stdin
+    flag, err := unix.FcntlInt(uintptr(fd), unix.F_GETFL, 0)
+    if err != nil {
+      _ = term.Restore(fd, oldState)
+      primary.Close()
+      secondary.Close()
+      return err
+    }
+    flag, err = unix.FcntlInt(uintptr(fd), unix.F_SETFL, flag|unix.O_NONBLOCK)
+    if err != nil {
+      _ = term.Restore(fd, oldState)
+      primary.Close()
+      secondary.Close()
+      return err
+    }
+
+    // Resize the pty to match the current terminal before the child starts
+    if err := pty.InheritSize(os.Stdin, primary); err != nil {
+      _ = term.Restore(fd, oldState)
+      primary.Close()
+      secondary.Close()
+      return err
+    }
+
+    // Keep listening for SIGWINCH for as long as the command is running, so
+    // live terminal resizes keep propagating to the pty and the recorder
+    // instead of only being applied once at startup. The listener is torn
+    // down when execCtx is cancelled, alongside the rest of the command.
+    ch := make(chan os.Signal, 1)
+    signal.Notify(ch, syscall.SIGWINCH)
+    command.sigwinchWG.Add(1)
+    go func() {
+      defer command.sigwinchWG.Done()
+      defer signal.Stop(ch)
+
+      for {
+        select {
+        case <-ch:
+          if err := pty.InheritSize(os.Stdin, primary); err != nil {
+            continue
+          }
+
+          if rows, cols, sizeErr := pty.Getsize(primary); sizeErr == nil {
+            command.recorderMu.Lock()
+            if command.recorder != nil {
+              command.recorder.resize(cols, rows)
+            }
+            command.recorderMu.Unlock()
+          }
+        case <-command.execCtx.Ctx.Done():
+          return
+        }
+      }
+    }()
+  } else {
+    stdinSrc = command.Stdin
+  }
+
+  stdoutDest := io.Writer(os.Stdout)
+  if command.Stdout != nil {
+    stdoutDest = command.Stdout
   }
-  func() { signal.Stop(ch); close(ch); close(errCh)}() // Cleanup signal and channels when done
 
   // Start the command
   err = c.Start()
   if err != nil {
-    return *command, err
+    if stdinIsRaw {
+      _ = term.Restore(fd, oldState)
+    }
+    primary.Close()
+    secondary.Close()
+    if command.SeparateStderr {
+      stderrRead.Close()
+      stderrWrite.Close()
+    }
+    return err
   }
 
-  // Create a context to track if the command is still running
-  cmdExecutionContext := generateContextWrapper()
+  if command.SeparateStderr {
+    // The child holds its own copy of the write end now; closing ours here
+    // is what lets the read goroutine see EOF when the child exits
+    stderrWrite.Close()
+  }
+
+  // Save state needed by Wait
+  command.cmd = c
+  command.primary = primary
+  command.secondary = secondary
+  command.stdinFd = fd
+  command.stdinIsRaw = stdinIsRaw
+  command.oldState = oldState
+  command.stderrRead = stderrRead
+  command.cgroupDir = cgroupDir
+  command.cgroupDirFile = cgroupDirFile
+
+  command.cmdExitCh = make(chan error, 1)
+  command.cmdExited = make(chan struct{})
+
+  // Make sure the broadcasters/replay rings exist even if the caller never
+  // registered a subscriber
+  command.ensureOutputBroadcaster()
+  command.ensureInputBroadcaster()
+
+  // Start the session recorder, if requested
+  if command.RecordTo != nil {
+    rows, cols, sizeErr := pty.Getsize(primary)
+    if sizeErr != nil {
+      rows, cols = 24, 80
+    }
 
-  // Create a bytes buffer to capture the command's output
-  var cmdOutput bytes.Buffer
+    rec, err := newAsciicastRecorder(command.RecordTo, cols, rows)
+    if err != nil {
+      _ = c.Process.Kill()
+      if stdinIsRaw {
+        _ = term.Restore(fd, oldState)
+      }
+      primary.Close()
+      secondary.Close()
+      return err
+    }
+    command.recorderMu.Lock()
+    command.recorder = rec
+    command.recorderMu.Unlock()
+  }
 
-  // Start goroutine to copy data from os.Stdin to ptm (via a custom writer)
-  var ptyWriterWaitGroup sync.WaitGroup
-  ptyWriterWaitGroup.Add(1)
+  // Start goroutine to copy data from stdin to ptm (via a custom writer)
+  command.ptyWriterWG.Add(1)
   stdinWriter := &Writer{
-    src: os.Stdin,
+    src: stdinSrc,
     dest: primary,
-    ctx: cmdExecutionContext,
+    ctx: command.execCtx,
   }
   go func() {
-    defer ptyWriterWaitGroup.Done()
+    defer command.ptyWriterWG.Done()
 
-    // Create a reader to get data from os.Stdin
+    // Create a reader to get data from stdin
     reader := bufio.NewReader(stdinWriter.src)
 
     // Create a bytes buffer
@@ -214,6 +989,18 @@ func (command *Command) RunInPTY() (Command, error) {
         } else {
           // Write data
           _, err = stdinWriter.Write(buf[:n])
+
+          // Tee the bytes sent to the child to the input ring/subscribers
+          _, _ = command.inputRing.Write(buf[:n])
+          command.inputBC.write(buf[:n])
+
+          if command.RecordInput {
+            command.recorderMu.Lock()
+            if command.recorder != nil {
+              command.recorder.record("i", buf[:n])
+            }
+            command.recorderMu.Unlock()
+          }
         }
       }
     }
@@ -221,16 +1008,15 @@ func (command *Command) RunInPTY() (Command, error) {
     return
   }()
 
-  // Start goroutine to copy data from ptm to os.Stdout
-  var stdoutWriterWaitGroup sync.WaitGroup
-  stdoutWriterWaitGroup.Add(1)
+  // Start goroutine to copy data from ptm to stdout
+  command.stdoutWriterWG.Add(1)
   stdoutWriter := &Writer{
     src: primary,
-    dest: os.Stdout,
-    ctx: cmdExecutionContext,
+    dest: stdoutDest,
+    ctx: command.execCtx,
   }
   go func() {
-    defer stdoutWriterWaitGroup.Done()
+    defer command.stdoutWriterWG.Done()
 
     // Create a bytes buffer
     buf := make([]byte, 4096)
@@ -259,7 +1045,17 @@ func (command *Command) RunInPTY() (Command, error) {
           }
 
           // Copy bytes to output bytes buffer
-          _, err = io.Copy(&cmdOutput, bytes.NewReader(buf[:n]))
+          _, err = io.Copy(&command.cmdOutput, bytes.NewReader(buf[:n]))
+
+          // Tee the bytes read from the pty to the output ring/subscribers
+          _, _ = command.outputRing.Write(buf[:n])
+          command.outputBC.write(buf[:n])
+
+          command.recorderMu.Lock()
+          if command.recorder != nil {
+            command.recorder.record("o", buf[:n])
+          }
+          command.recorderMu.Unlock()
         }
       }
     }
@@ -267,49 +1063,134 @@ func (command *Command) RunInPTY() (Command, error) {
     return
   }()
 
-  // Wait for the command to exit
-  cmdExitCh := make(chan error, 1)
-  var cmdExecutionWaitGroup sync.WaitGroup
-  cmdExecutionWaitGroup.Add(1)
+  // Start goroutine to copy data from the stderr pipe, in SeparateStderr mode
+  if command.SeparateStderr {
+    command.stderrWriterWG.Add(1)
+    go func() {
+      defer command.stderrWriterWG.Done()
+      defer stderrRead.Close()
+
+      buf := make([]byte, 4096)
+      for {
+        n, err := stderrRead.Read(buf)
+        if n > 0 {
+          command.appendStderr(buf[:n])
+
+          if command.StderrWriter != nil {
+            _, _ = command.StderrWriter.Write(buf[:n])
+          }
+        }
+        if err != nil {
+          // EOF once the child (the only remaining holder of the write end)
+          // exits
+          return
+        }
+      }
+    }()
+  }
+
+  // Enforce Timeout, if configured, by terminating the child once it elapses
+  if command.Timeout > 0 {
+    go func() {
+      timer := time.NewTimer(command.Timeout)
+      defer timer.Stop()
+
+      select {
+      case <-timer.C:
+        command.terminate(ErrTimeout)
+      case <-command.execCtx.Ctx.Done():
+      }
+    }()
+  }
+
+  // Wait for the command to exit in the background and tear down shared state
+  command.cmdExecutionWG.Add(1)
   go func() {
-    defer cmdExecutionWaitGroup.Done()
+    defer command.cmdExecutionWG.Done()
 
-    cmdExitCh <- c.Wait()
+    command.cmdExitCh <- c.Wait()
+    close(command.cmdExited)
 
-    // Cancel context
-    cmdExecutionContext.Cancel()
+    // Collect final cgroup stats and remove the sub-cgroup, now that the
+    // child (its only other occupant) has exited
+    if command.Cgroup != nil {
+      command.CgroupStats = teardownCgroup(command.cgroupDirFile, command.cgroupDir)
+    }
+
+    // Cancel context (no-op if terminate already canceled it)
+    command.execCtx.Cancel()
 
     // Close pty
     primary.Close()
     secondary.Close()
 
     // Wait for output writer to return
-    stdoutWriterWaitGroup.Wait()
+    command.stdoutWriterWG.Wait()
 
     // Wait for pty writer to return
-    ptyWriterWaitGroup.Wait()
+    command.ptyWriterWG.Wait()
+
+    // Wait for the stderr reader to see EOF, if SeparateStderr is enabled
+    command.stderrWriterWG.Wait()
+
+    // Wait for the SIGWINCH listener to see execCtx cancelled and stop, so
+    // it can't still be queuing a resize event past this point
+    command.sigwinchWG.Wait()
+
+    // Unsubscribe and drain every output/input subscriber so their Write
+    // calls have actually returned before Wait() hands control back to the
+    // caller, instead of only waiting for the pty copy loops to finish
+    // enqueueing
+    command.bcMu.Lock()
+    outputBC, inputBC := command.outputBC, command.inputBC
+    command.bcMu.Unlock()
+    if outputBC != nil {
+      outputBC.close()
+    }
+    if inputBC != nil {
+      inputBC.close()
+    }
+
+    // No more events will be recorded past this point; flush and close
+    command.recorderMu.Lock()
+    command.recorder.close()
+    command.recorderMu.Unlock()
 
     return
   }()
 
-  cmdExecutionWaitGroup.Wait()
+  return nil
+}
+
+// Wait blocks until the command started by Start has exited, then fills in
+// ExitCode, Output and Completed. It returns ErrTimeout or ErrCanceled if the
+// command was stopped via Command.Timeout or an external context instead of
+// exiting on its own.
+func (command *Command) Wait() (*Command, error) {
+  command.cmdExecutionWG.Wait()
+
+  // Restore the terminal now that we're done reading from stdin, if we were
+  // the ones who put it in raw mode
+  if command.stdinIsRaw {
+    _ = term.Restore(command.stdinFd, command.oldState)
+  }
 
   // Get command exit code and save it
-  cmdExit := <-cmdExitCh
-  close(cmdExitCh)
+  cmdExit := <-command.cmdExitCh
+  close(command.cmdExitCh)
   if exitError, ok := cmdExit.(*exec.ExitError); ok {
     // The command exited with a non-zero status (an error)
     command.ExitCode = exitError.ExitCode()
-  } else if cmdExit != nil {
-    // Some other error occurred
-    return *command, cmdExit
+  } else if cmdExit != nil && command.terminationErr == nil {
+    // Some other error occurred and it wasn't caused by our own termination
+    return command, cmdExit
   } else {
     // The command exited successfully
     command.ExitCode = 0
   }
 
   // Convert command output from bytes to string
-  cmdOutputString := cmdOutput.String()
+  cmdOutputString := command.cmdOutput.String()
 
   // Clean up command output
   cmdOutputStringCleaned := cleanupString(cmdOutputString)
@@ -317,7 +1198,48 @@ func (command *Command) RunInPTY() (Command, error) {
   // Save cleaned up command output
   command.Output = cmdOutputStringCleaned
 
+  if command.SeparateStderr {
+    command.stderrMu.Lock()
+    command.Stderr = command.stderrBuf.String()
+    command.stderrMu.Unlock()
+  }
+
   // Mark command as completed and return
   command.Completed = true
-  return *command, nil
+
+  if command.terminationErr != nil {
+    return command, command.terminationErr
+  }
+
+  return command, nil
+}
+
+// RunInPTY starts the command and blocks until it exits, returning the same
+// result as calling Start followed by Wait. It exists for callers that don't
+// need to inspect the running command before it finishes.
+func (command *Command) RunInPTY() (*Command, error) {
+  if err := command.Start(); err != nil {
+    return command, err
+  }
+
+  return command.Wait()
+}
+
+// RunInPTYContext behaves like RunInPTY, except ctx being canceled (or
+// reaching its deadline) terminates the child early and causes Wait to
+// return ErrCanceled.
+func (command *Command) RunInPTYContext(ctx context.Context) (*Command, error) {
+  if err := command.Start(); err != nil {
+    return command, err
+  }
+
+  go func() {
+    select {
+    case <-ctx.Done():
+      command.terminate(ErrCanceled)
+    case <-command.execCtx.Ctx.Done():
+    }
+  }()
+
+  return command.Wait()
 }
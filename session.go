@@ -0,0 +1,206 @@
+package ptywrapper
+
+import (
+  // Modules in GOROOT
+  "errors"
+  "fmt"
+  "io"
+  "regexp"
+  "sync"
+  "time"
+)
+
+// defaultExpectBufferSize bounds how much decoded output Session keeps
+// around for Expect to search when Command.ExpectBufferSize is left unset.
+const defaultExpectBufferSize = 64 * 1024
+
+var (
+  // ErrSessionEOF is returned by Expect/ExpectAny when the command exits
+  // before any pattern matches.
+  ErrSessionEOF = errors.New("ptywrapper: session ended before pattern matched")
+
+  // ErrExpectTimeout is returned by Expect/ExpectAny when timeout elapses
+  // before any pattern matches.
+  ErrExpectTimeout = errors.New("ptywrapper: expect timed out waiting for pattern")
+)
+
+// Pattern is a single candidate for ExpectAny, pre-compiled so the index of
+// the match can be reported back to the caller.
+type Pattern struct {
+  re *regexp.Regexp
+}
+
+// NewPattern compiles pattern (a string or *regexp.Regexp) into a Pattern
+// usable with ExpectAny.
+func NewPattern(pattern interface{}) (Pattern, error) {
+  re, err := compilePattern(pattern)
+  if err != nil {
+    return Pattern{}, err
+  }
+
+  return Pattern{re: re}, nil
+}
+
+func compilePattern(pattern interface{}) (*regexp.Regexp, error) {
+  switch p := pattern.(type) {
+  case *regexp.Regexp:
+    return p, nil
+  case string:
+    return regexp.Compile(p)
+  default:
+    return nil, fmt.Errorf("ptywrapper: pattern must be a string or *regexp.Regexp, got %T", pattern)
+  }
+}
+
+// Session layers an expect(1)-style scripted interaction API on top of a
+// Command's Start/broadcaster support, so callers can drive an interactive
+// program without a human at the terminal.
+type Session struct {
+  command     *Command
+  logger      io.Writer
+  unsubscribe func()
+
+  mu   sync.Mutex
+  cond *sync.Cond
+  buf  []byte
+  eof  bool
+}
+
+// NewSession starts command (if it hasn't been started yet) and attaches a
+// Session to it via AddOutputWriter.
+func NewSession(command *Command) (*Session, error) {
+  if command.Cmd() == nil {
+    if err := command.Start(); err != nil {
+      return nil, err
+    }
+  }
+
+  session := &Session{
+    command: command,
+    logger:  command.LogExpect,
+  }
+  session.cond = sync.NewCond(&session.mu)
+  session.unsubscribe = command.AddOutputWriter(session, command.WriterPolicy)
+
+  go func() {
+    <-command.Done()
+
+    session.mu.Lock()
+    session.eof = true
+    session.mu.Unlock()
+
+    session.cond.Broadcast()
+  }()
+
+  return session, nil
+}
+
+// Write implements io.Writer so *Session can be registered via
+// Command.AddOutputWriter; it feeds the rolling buffer Expect searches.
+func (s *Session) Write(p []byte) (int, error) {
+  maxBuf := s.command.ExpectBufferSize
+  if maxBuf <= 0 {
+    maxBuf = defaultExpectBufferSize
+  }
+
+  s.mu.Lock()
+  s.buf = append(s.buf, p...)
+  if len(s.buf) > maxBuf {
+    s.buf = s.buf[len(s.buf)-maxBuf:]
+  }
+  s.mu.Unlock()
+
+  s.cond.Broadcast()
+
+  return len(p), nil
+}
+
+// Expect blocks until the decoded (ANSI-stripped) output buffer matches
+// pattern (a string or *regexp.Regexp), or timeout elapses, or the command
+// exits first.
+func (s *Session) Expect(pattern interface{}, timeout time.Duration) ([]string, error) {
+  p, err := NewPattern(pattern)
+  if err != nil {
+    return nil, err
+  }
+
+  _, match, err := s.ExpectAny([]Pattern{p}, timeout)
+
+  return match, err
+}
+
+// ExpectAny is like Expect, but blocks until any of patterns matches,
+// returning the index of the one that did.
+func (s *Session) ExpectAny(patterns []Pattern, timeout time.Duration) (int, []string, error) {
+  var timedOut chan struct{}
+  if timeout > 0 {
+    timedOut = make(chan struct{})
+    timer := time.AfterFunc(timeout, func() {
+      close(timedOut)
+      s.cond.Broadcast()
+    })
+    defer timer.Stop()
+  }
+
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  for {
+    decoded := ansiEscapePattern.ReplaceAllString(string(s.buf), "")
+
+    for i, p := range patterns {
+      if match := p.re.FindStringSubmatch(decoded); match != nil {
+        // Matched output (and everything preceding it) has served its
+        // purpose; drop it so the next Expect call only sees what's new
+        end := p.re.FindStringIndex(decoded)[1]
+        s.buf = []byte(decoded[end:])
+
+        s.logf("expect: matched pattern %d: %q", i, match[0])
+
+        return i, match, nil
+      }
+    }
+
+    if s.eof {
+      s.logf("expect: command exited before any pattern matched")
+      return -1, nil, ErrSessionEOF
+    }
+
+    if timedOut != nil {
+      select {
+      case <-timedOut:
+        s.logf("expect: timed out after %s", timeout)
+        return -1, nil, ErrExpectTimeout
+      default:
+      }
+    }
+
+    s.cond.Wait()
+  }
+}
+
+func (s *Session) logf(format string, args ...interface{}) {
+  if s.logger == nil {
+    return
+  }
+
+  fmt.Fprintf(s.logger, format+"\n", args...)
+}
+
+// Send writes str to the pty as-is.
+func (s *Session) Send(str string) error {
+  _, err := s.command.PTY().Write([]byte(str))
+
+  return err
+}
+
+// SendLine writes str followed by a newline to the pty.
+func (s *Session) SendLine(str string) error {
+  return s.Send(str + "\n")
+}
+
+// Close stops feeding the Session's buffer. It does not affect the
+// underlying Command; call Wait on that separately.
+func (s *Session) Close() {
+  s.unsubscribe()
+}
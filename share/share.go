@@ -0,0 +1,212 @@
+// Package share exposes a running ptywrapper.Command over the network as an
+// interactive shared terminal, using a minimal xterm.js-compatible JSON
+// frame protocol over a WebSocket.
+package share
+
+import (
+  // Modules in GOROOT
+  "context"
+  "encoding/base64"
+  "encoding/json"
+  "errors"
+  "net/http"
+  "sync"
+
+  // External modules
+  "github.com/creack/pty"
+  "github.com/gorilla/websocket"
+
+  // Modules from the project
+  "github.com/fearlessdots/ptywrapper"
+)
+
+// Frame is the JSON message exchanged over the websocket. "write" frames
+// flow server -> client carrying pty output; "input" and "resize" frames
+// flow client -> server.
+type Frame struct {
+  Type string `json:"type"`
+  Data string `json:"data,omitempty"`
+  Cols int    `json:"cols,omitempty"`
+  Rows int    `json:"rows,omitempty"`
+}
+
+// Options configures Serve.
+type Options struct {
+  // Path is the HTTP path the websocket endpoint is served on. Defaults to
+  // "/ws".
+  Path string
+
+  // WriteToken, when set, is the token a viewer must pass as the "token"
+  // query parameter to be granted write (input/resize) access. Viewers
+  // without a matching token still connect, but read-only. Ignored when
+  // Authenticate is set.
+  WriteToken string
+
+  // Authenticate, when set, is called for every connection before the
+  // websocket upgrade. Returning ok=false rejects the connection outright;
+  // writable reports whether the connection should be granted write access.
+  Authenticate func(r *http.Request) (writable bool, ok bool)
+}
+
+type viewer struct {
+  conn     *websocket.Conn
+  writable bool
+  sendMu   sync.Mutex
+}
+
+// Write implements io.Writer so *viewer can be registered via
+// Command.AddOutputWriter individually, instead of every viewer sharing one
+// server-wide subscription; that's what lets each viewer get its own replay
+// of buffered output on connect, regardless of when it joins.
+func (v *viewer) Write(p []byte) (int, error) {
+  payload, err := json.Marshal(Frame{Type: "write", Data: base64.StdEncoding.EncodeToString(p)})
+  if err != nil {
+    return 0, err
+  }
+
+  v.sendMu.Lock()
+  err = v.conn.WriteMessage(websocket.TextMessage, payload)
+  v.sendMu.Unlock()
+
+  return len(p), err
+}
+
+type server struct {
+  cmd      *ptywrapper.Command
+  opts     Options
+  upgrader websocket.Upgrader
+
+  mu      sync.Mutex
+  viewers map[*viewer]struct{}
+}
+
+// Serve attaches to cmd (which must already be running, e.g. via Start or
+// RunInPTYContext) and serves it over addr until the command exits or the
+// HTTP server fails to start. Viewers connect to Path and receive a replay
+// of buffered output followed by a live stream; only viewers granted write
+// access (per Options) can send input/resize frames back, and any number of
+// viewers may hold it at once.
+func Serve(cmd *ptywrapper.Command, addr string, opts Options) error {
+  if opts.Path == "" {
+    opts.Path = "/ws"
+  }
+
+  s := &server{
+    cmd:     cmd,
+    opts:    opts,
+    viewers: make(map[*viewer]struct{}),
+    upgrader: websocket.Upgrader{
+      ReadBufferSize:  4096,
+      WriteBufferSize: 4096,
+      CheckOrigin:     func(r *http.Request) bool { return true },
+    },
+  }
+
+  mux := http.NewServeMux()
+  mux.HandleFunc(opts.Path, s.handleWS)
+  httpServer := &http.Server{Addr: addr, Handler: mux}
+
+  go func() {
+    <-cmd.Done()
+    s.detachAll()
+    _ = httpServer.Shutdown(context.Background())
+  }()
+
+  err := httpServer.ListenAndServe()
+  if errors.Is(err, http.ErrServerClosed) {
+    return nil
+  }
+
+  return err
+}
+
+// detachAll closes every connected viewer's websocket, used once the
+// command exits.
+func (s *server) detachAll() {
+  s.mu.Lock()
+  viewers := make([]*viewer, 0, len(s.viewers))
+  for v := range s.viewers {
+    viewers = append(viewers, v)
+  }
+  s.viewers = make(map[*viewer]struct{})
+  s.mu.Unlock()
+
+  for _, v := range viewers {
+    v.sendMu.Lock()
+    _ = v.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "command exited"))
+    v.sendMu.Unlock()
+    v.conn.Close()
+  }
+}
+
+func (s *server) authorize(r *http.Request) (writable bool, ok bool) {
+  if s.opts.Authenticate != nil {
+    return s.opts.Authenticate(r)
+  }
+
+  if s.opts.WriteToken == "" {
+    // No auth configured: everyone connects, nobody gets write access
+    return false, true
+  }
+
+  return r.URL.Query().Get("token") == s.opts.WriteToken, true
+}
+
+func (s *server) handleWS(w http.ResponseWriter, r *http.Request) {
+  writable, ok := s.authorize(r)
+  if !ok {
+    http.Error(w, "forbidden", http.StatusForbidden)
+    return
+  }
+
+  conn, err := s.upgrader.Upgrade(w, r, nil)
+  if err != nil {
+    return
+  }
+
+  v := &viewer{conn: conn, writable: writable}
+
+  // Register this viewer on its own subscription, so it gets a replay of
+  // whatever output is already buffered followed by the live stream,
+  // regardless of when it joins relative to other viewers
+  unsubscribe := s.cmd.AddOutputWriter(v, s.cmd.WriterPolicy)
+
+  s.mu.Lock()
+  s.viewers[v] = struct{}{}
+  s.mu.Unlock()
+
+  defer func() {
+    unsubscribe()
+    s.mu.Lock()
+    delete(s.viewers, v)
+    s.mu.Unlock()
+    conn.Close()
+  }()
+
+  for {
+    _, payload, err := conn.ReadMessage()
+    if err != nil {
+      return
+    }
+
+    if !v.writable {
+      continue
+    }
+
+    var f Frame
+    if err := json.Unmarshal(payload, &f); err != nil {
+      continue
+    }
+
+    switch f.Type {
+    case "input":
+      data, err := base64.StdEncoding.DecodeString(f.Data)
+      if err != nil {
+        continue
+      }
+      _, _ = s.cmd.PTY().Write(data)
+    case "resize":
+      _ = pty.Setsize(s.cmd.PTY(), &pty.Winsize{Rows: uint16(f.Rows), Cols: uint16(f.Cols)})
+    }
+  }
+}
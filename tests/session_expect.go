@@ -0,0 +1,53 @@
+package main
+
+import (
+  // Modules in GOROOT
+  "fmt"
+  "time"
+
+  // Modules from the project
+  "github.com/fearlessdots/ptywrapper"
+)
+
+func main() {
+  fmt.Println("=> Testing Session/Expect...")
+  fmt.Println("")
+
+  cmd := &ptywrapper.Command{
+    Entry:   "/bin/sh",
+    Discard: true,
+  }
+
+  session, err := ptywrapper.NewSession(cmd)
+  if err != nil {
+    panic(err)
+  }
+  defer session.Close()
+
+  // "$ " for a regular user, "# " for root (e.g. in most containers/CI)
+  if _, err := session.Expect(`[#$]\s*$`, 2*time.Second); err != nil {
+    panic(err)
+  }
+
+  if err := session.SendLine("echo hello-ptywrapper"); err != nil {
+    panic(err)
+  }
+
+  match, err := session.Expect("hello-ptywrapper", 2*time.Second)
+  if err != nil {
+    panic(err)
+  }
+  fmt.Println("Matched:", match[0])
+
+  if err := session.SendLine("exit"); err != nil {
+    panic(err)
+  }
+
+  completedCmd, err := cmd.Wait()
+  if err != nil {
+    fmt.Println("Error:", err)
+    return
+  }
+
+  fmt.Println("Exit code:", completedCmd.ExitCode)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+  // Modules in GOROOT
+  "fmt"
+  "time"
+
+  // Modules from the project
+  "github.com/fearlessdots/ptywrapper"
+)
+
+func main() {
+  fmt.Println("=> Testing Start/Wait split...")
+  fmt.Println("")
+
+  cmd := &ptywrapper.Command{
+    Entry:   "/bin/sh",
+    Args:    []string{"-c", "sleep 1; echo done"},
+    Discard: true,
+  }
+
+  if err := cmd.Start(); err != nil {
+    panic(err)
+  }
+
+  fmt.Println("Started PID:", cmd.PID())
+
+  select {
+  case <-cmd.Done():
+    panic("command finished before it should have")
+  case <-time.After(100 * time.Millisecond):
+    fmt.Println("Still running, as expected")
+  }
+
+  completedCmd, err := cmd.Wait()
+  if err != nil {
+    fmt.Println("Error:", err)
+    return
+  }
+
+  fmt.Println("Exit code:", completedCmd.ExitCode)
+  fmt.Println("Output:", completedCmd.Output)
+}